@@ -1,5 +1,7 @@
 package commit
 
+import "time"
+
 // ------------------------------------------
 //                  COMMON
 // ------------------------------------------
@@ -18,8 +20,48 @@ const (
 // Common args struct because RPCs generally have the transaction ID as their only argument
 type RPCArgs struct {
 	Tid int
+	// Subtid selects which of Tid's sequential voting rounds this call
+	// targets. A Tid that is never split into subtransactions just uses 0.
+	Subtid int
+	// Isolation pins the validation level for an Optimistic transaction the
+	// first time it is seen; ignored for Pessimistic transactions.
+	Isolation Isolation
+}
+
+// txnKey identifies a single subtransaction's voting round. Prepare/Commit/
+// Abort/PreCommit operate at this granularity; Finalize operates on the
+// whole Tid once every subtid it contains has committed.
+type txnKey struct {
+	Tid    int
+	Subtid int
 }
 
+// FinalizeArgs tells the server whether to apply or discard the ops every
+// committed subtid of Tid has accumulated.
+type FinalizeArgs struct {
+	Tid   int
+	Apply bool
+}
+
+// TxnMode selects how a transaction's Prepare phase detects conflicts:
+// Pessimistic acquires write locks up front, Optimistic defers detection to
+// a read-set/write-set validation at Prepare time.
+type TxnMode int
+
+const (
+	Pessimistic TxnMode = iota
+	Optimistic
+)
+
+// Isolation is the conflict-detection level an Optimistic transaction is
+// validated against at Prepare time.
+type Isolation int
+
+const (
+	SerializableSnapshot Isolation = iota // validate the read set against the current version chain
+	Serializable                          // also validate the write set, guarding against phantom writes
+)
+
 type PrepareReply struct {
 	Relevant bool // essentially has this server logged any ops for the tid
 	VoteYes  bool // if all locks are acquired toggle should be set to true, else false
@@ -29,6 +71,48 @@ type QueryReply struct {
 	Transactions map[int]TransactionState // mapping tid to some transaction state
 }
 
+// RAMPGetArgs requests the latest committed version of each key.
+type RAMPGetArgs struct {
+	Keys []string
+}
+
+// RAMPResult is the latest committed version of a key, together with the
+// metadata a RAMP client needs to decide whether to run a repair round.
+type RAMPResult struct {
+	Value    interface{}
+	Tid      int
+	CommitTS uint64
+	Siblings uint64 // bloom filter covering every key Tid wrote across all servers
+}
+
+type RAMPGetReply struct {
+	Results map[string]RAMPResult
+}
+
+// GetVersionArgs requests the oldest version of Key committed at or after
+// MinTS, for a RAMP client's second-round repair.
+type GetVersionArgs struct {
+	Key   string
+	MinTS uint64
+}
+
+type GetVersionReply struct {
+	Result RAMPResult
+	Found  bool
+}
+
+type StatsReply struct {
+	QueueDepth int           // transactions currently waiting in the commit queue
+	AvgWait    time.Duration // average wait over the admissions that had to wait; immediate admissions are not counted
+}
+
 type CommitReply struct {
-	GetResults map[string]interface{} // get the results for the client
+	GetResults map[string]VersionedValue // get results for the client, keyed by the key read
+}
+
+// VersionedValue is the value a Get resolved to, together with the commitTS
+// of the version it came from, so a client can tell which snapshot it read.
+type VersionedValue struct {
+	Value    interface{}
+	CommitTS uint64
 }
@@ -0,0 +1,70 @@
+package commit
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// bloomAdd sets the 3 hash bits for key in b and returns the updated filter.
+func bloomAdd(b uint64, key string) uint64 {
+	for seed := uint32(0); seed < 3; seed++ {
+		b |= 1 << (murmur3(key, seed) % 64)
+	}
+	return b
+}
+
+// bloomMayContain reports whether b may have been built from a set
+// containing key; false negatives never happen, false positives can.
+func bloomMayContain(b uint64, key string) bool {
+	for seed := uint32(0); seed < 3; seed++ {
+		if b&(1<<(murmur3(key, seed)%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// murmur3 is the standard MurmurHash3 x86_32 hash, used to derive the
+// 3 bit positions for the RAMP sibling-key bloom filter.
+func murmur3(key string, seed uint32) uint64 {
+	const c1, c2 = 0xcc9e2d51, 0x1b873593
+	data := []byte(key)
+	h := seed
+
+	nblocks := len(data) / 4
+	for i := 0; i < nblocks; i++ {
+		k := binary.LittleEndian.Uint32(data[i*4:])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+
+		h ^= k
+		h = bits.RotateLeft32(h, 13)
+		h = h*5 + 0xe6546b64
+	}
+
+	var k uint32
+	switch tail := data[nblocks*4:]; len(tail) {
+	case 3:
+		k ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(tail[0])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		h ^= k
+	}
+
+	h ^= uint32(len(data))
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+
+	return uint64(h)
+}
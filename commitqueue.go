@@ -0,0 +1,90 @@
+package commit
+
+import "time"
+
+// commitQueueCap bounds how many pessimistic transactions may be waiting on
+// a key conflict at once; beyond this Prepare rejects with a vote of no
+// instead of blocking indefinitely.
+const commitQueueCap = 100
+
+// admitCommitQueue blocks key until none of ops' "set" keys overlap an
+// in-flight subtransaction's writes, then bumps the per-key
+// write counters so later admissions see key as in-flight too. "get" ops
+// are never blocked or tracked here: MVCC resolves them against the
+// version chain without a lock, so they never conflict with anything.
+// It reports false instead of waiting once the queue is already at
+// commitQueueCap. Waiters are all woken by one Broadcast and are not
+// admitted in the order they arrived.
+func (sv *Server) admitCommitQueue(key txnKey, ops []Operation) bool {
+	sv.cqMu.Lock()
+	defer sv.cqMu.Unlock()
+
+	start := time.Now()
+	waited := false
+	for !sv.canAdmitLocked(ops) {
+		if sv.queueDepth >= commitQueueCap {
+			return false
+		}
+		waited = true
+		sv.queueDepth++
+		sv.cqCond.Wait()
+		sv.queueDepth--
+	}
+
+	for _, op := range ops {
+		if op.OpType == "set" {
+			sv.writers[op.Key]++
+		}
+	}
+	sv.cqAdmitted[key] = true
+
+	if waited {
+		sv.waitCount++
+		sv.waitTotal += time.Since(start)
+	}
+	return true
+}
+
+// canAdmitLocked reports whether ops' "set" keys are all free of an
+// in-flight writer. Callers must hold cqMu.
+func (sv *Server) canAdmitLocked(ops []Operation) bool {
+	for _, op := range ops {
+		if op.OpType == "set" && sv.writers[op.Key] > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// releaseCommitQueue decrements key's write counters, if it was ever
+// admitted, and wakes any subtransaction waiting on them.
+func (sv *Server) releaseCommitQueue(key txnKey, ops []Operation) {
+	sv.cqMu.Lock()
+	defer sv.cqMu.Unlock()
+
+	if !sv.cqAdmitted[key] {
+		return
+	}
+	delete(sv.cqAdmitted, key)
+
+	for _, op := range ops {
+		if op.OpType == "set" {
+			sv.writers[op.Key]--
+		}
+	}
+	sv.cqCond.Broadcast()
+}
+
+// Stats handler
+//
+// This function reports commit-queue depth and average admission wait time
+// so contention can be observed from outside the server.
+func (sv *Server) Stats(args struct{}, reply *StatsReply) {
+	sv.cqMu.Lock()
+	defer sv.cqMu.Unlock()
+
+	reply.QueueDepth = sv.queueDepth
+	if sv.waitCount > 0 {
+		reply.AvgWait = sv.waitTotal / time.Duration(sv.waitCount)
+	}
+}
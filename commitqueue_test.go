@@ -0,0 +1,41 @@
+package commit
+
+import (
+	"testing"
+	"time"
+)
+
+// TestReadPrepareDoesNotBlockOnWriter confirms a read-only Pessimistic
+// Prepare is admitted immediately even while an unrelated write to the
+// same key is still in the commit queue: MVCC resolves "get" ops against
+// the version chain without a lock, so they must never wait on a writer.
+func TestReadPrepareDoesNotBlockOnWriter(t *testing.T) {
+	sv := MakeServer([]string{"a"}, "")
+	defer sv.Close()
+
+	sv.Set(1, 0, "a", "v1")
+	var prep1 PrepareReply
+	sv.Prepare(&RPCArgs{Tid: 1}, &prep1)
+	if !prep1.VoteYes {
+		t.Fatalf("writer tid 1 should prepare cleanly, got VoteYes=false")
+	}
+	// tid 1 is now holding "a"'s write lock, parked between Prepare and
+	// Commit, exactly like a writer still admitted in the commit queue.
+
+	sv.Get(2, 0, "a")
+	done := make(chan bool, 1)
+	go func() {
+		var prep2 PrepareReply
+		sv.Prepare(&RPCArgs{Tid: 2}, &prep2)
+		done <- prep2.VoteYes
+	}()
+
+	select {
+	case voteYes := <-done:
+		if !voteYes {
+			t.Fatal("read-only tid 2 should prepare successfully")
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("read-only Prepare blocked on an in-flight writer's commit-queue admission")
+	}
+}
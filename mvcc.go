@@ -0,0 +1,59 @@
+package commit
+
+import "time"
+
+// gcInterval is how often the version GC sweeps the store.
+const gcInterval = 100 * time.Millisecond
+
+// gcLoop periodically trims each key's version chain down to the versions
+// still reachable by an active transaction's startTS.
+func (sv *Server) gcLoop() {
+	ticker := time.NewTicker(gcInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			sv.gcOnce()
+		case <-sv.gcStop:
+			return
+		}
+	}
+}
+
+// gcOnce trims versions older than the oldest active startTS across all
+// keys. A version is kept if it is the latest one at or before the cutoff,
+// since some active transaction may still need to resolve against it.
+func (sv *Server) gcOnce() {
+	// version slices are otherwise only ever mutated while sv.mu is held
+	// (Finalize, commitOptimisticLocked), so hold it here too rather than
+	// item.mu, which only guards write-write conflicts in Prepare.
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	var oldest uint64 = sv.nextTS
+	for _, ts := range sv.startTS {
+		if ts < oldest {
+			oldest = ts
+		}
+	}
+
+	for _, item := range sv.store {
+		item.versions = trimVersions(item.versions, oldest)
+	}
+}
+
+// trimVersions drops every version strictly older than cutoff, except the
+// single newest one at or before cutoff (it may still be read by a txn
+// whose startTS falls in the gap).
+func trimVersions(versions []version, cutoff uint64) []version {
+	keepFrom := 0
+	for i, v := range versions {
+		if v.commitTS <= cutoff {
+			keepFrom = i
+		} else {
+			break
+		}
+	}
+	return versions[keepFrom:]
+}
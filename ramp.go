@@ -0,0 +1,97 @@
+package commit
+
+// RAMPGet handler
+//
+// This function returns the latest committed version of each requested key,
+// along with the metadata (Tid, CommitTS, Siblings) a RAMP client needs to
+// detect a partial read across partitions.
+func (sv *Server) RAMPGet(args *RAMPGetArgs, reply *RAMPGetReply) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	reply.Results = make(map[string]RAMPResult, len(args.Keys))
+	for _, key := range args.Keys {
+		item, ok := sv.store[key]
+		if !ok || len(item.versions) == 0 {
+			continue
+		}
+		v := item.versions[len(item.versions)-1]
+		reply.Results[key] = RAMPResult{Value: v.value, Tid: v.txnID, CommitTS: v.commitTS, Siblings: v.siblingsBloom}
+	}
+}
+
+// GetVersion handler
+//
+// This function returns the oldest version of Key committed at or after
+// MinTS, which is what a RAMP client's repair round asks for once it
+// suspects it read Key's value from before a sibling write landed.
+func (sv *Server) GetVersion(args *GetVersionArgs, reply *GetVersionReply) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	item, ok := sv.store[args.Key]
+	if !ok {
+		return
+	}
+	for _, v := range item.versions {
+		if v.commitTS >= args.MinTS {
+			reply.Result = RAMPResult{Value: v.value, Tid: v.txnID, CommitTS: v.commitTS, Siblings: v.siblingsBloom}
+			reply.Found = true
+			return
+		}
+	}
+}
+
+// RAMPClient performs read-atomic multi-partition reads against a set of
+// Servers without locks or coordination, per Lu et al.'s RAMP design: a
+// first round fetches every key, one at a time, and a second round re-fetches
+// any key whose sibling bloom filter indicates a read landed before a
+// co-transaction's write did.
+type RAMPClient struct {
+	// Route returns the Server that owns key.
+	Route func(key string) *Server
+}
+
+// Get performs a read-atomic read of keys, repairing any partial commit it
+// observes.
+func (c *RAMPClient) Get(keys []string) map[string]interface{} {
+	first := make(map[string]RAMPResult, len(keys))
+	for _, key := range keys {
+		var reply RAMPGetReply
+		c.Route(key).RAMPGet(&RAMPGetArgs{Keys: []string{key}}, &reply)
+		if res, ok := reply.Results[key]; ok {
+			first[key] = res
+		}
+	}
+
+	out := make(map[string]interface{}, len(keys))
+	for key, res := range first {
+		out[key] = res.Value
+	}
+
+	// Repair round: if key's siblings bloom may cover another key in this
+	// read whose version is older, that other key was read from before
+	// key's co-transaction finished writing - re-fetch it at key's commitTS.
+	for key, res := range first {
+		for _, other := range keys {
+			if other == key {
+				continue
+			}
+			otherRes, ok := first[other]
+			if ok && otherRes.CommitTS >= res.CommitTS {
+				continue
+			}
+			if !bloomMayContain(res.Siblings, other) {
+				continue
+			}
+
+			var reply GetVersionReply
+			c.Route(other).GetVersion(&GetVersionArgs{Key: other, MinTS: res.CommitTS}, &reply)
+			if reply.Found {
+				out[other] = reply.Result.Value
+			}
+		}
+	}
+
+	return out
+}
@@ -1,43 +1,144 @@
 package commit
 
 import (
+	"context"
 	"sync"
+	"time"
 )
 
+// version is one committed value in a key's MVCC chain.
+type version struct {
+	value    interface{}
+	commitTS uint64
+	txnID    int
+	// siblingsBloom covers every key the writing transaction touched
+	// across all servers, so a RAMP read can tell it needs a repair round.
+	siblingsBloom uint64
+}
+
 type StoreItem struct {
-	value interface{}
-	lock  sync.RWMutex
-	// Any extra fields here
+	mu sync.Mutex // guards writes during Prepare/Commit; reads never take this lock
+	// versions is the key's version chain, oldest first. A Get resolves
+	// against this chain instead of a live value so it never blocks on mu.
+	versions []version
 }
 
 type Server struct {
 	mu    sync.Mutex
 	store map[string]*StoreItem
 	// Your fields here
-	txnLogs   map[int][]Operation      // list of the get or set operations done
-	txnState  map[int]TransactionState // tid mapping to state
-	heldLocks map[int][]string         // tid mapping to list of keys under a lock
+	// txnLogs, txnState and heldLocks are keyed per subtransaction: a Tid
+	// whose calls all use Subtid 0 just lives at {Tid, 0}.
+	txnLogs   map[txnKey][]Operation      // list of the get or set operations done
+	txnState  map[txnKey]TransactionState // subtid mapping to state
+	heldLocks map[txnKey][]string         // subtid mapping to list of keys under a write lock
+
+	// finalOps accumulates every committed subtid's ops for a Tid, durably,
+	// until Finalize applies or discards them as one unit. finalLocks is the
+	// matching set of write locks Commit took for those ops: they stay held
+	// until Finalize actually decides, not released at Commit time, so an
+	// unrelated transaction can't land a write out of lock order while
+	// Tid's Finalize is still pending.
+	finalOps   map[int][]Operation
+	finalLocks map[int][]string
+
+	nextTS  uint64         // monotonic clock source for startTS/commitTS
+	startTS map[int]uint64 // tid -> startTS, assigned when its first op is logged
+
+	gcStop    chan struct{} // closed to stop the version GC goroutine; see Close
+	closeOnce sync.Once
+
+	// wal durably persists every state transition below so a restarted
+	// Server can recover instead of losing track of in-flight txns. See
+	// wal.go. walCommits counts commits since the last snapshot.
+	wal        Logger
+	walCommits int
+
+	// txnCtx holds the cancellation handle for each subtid's in-flight
+	// Prepare, so Stop can interrupt one that's starving on a hot key. See
+	// the Stop handler in stop.go.
+	txnCtx map[txnKey]pendingPrepare
+
+	// Optimistic (STM) path: populated by GetOptimistic/SetOptimistic
+	// instead of txnLogs/heldLocks. See stm.go.
+	txnMode   map[int]TxnMode
+	isolation map[int]Isolation
+	readSet   map[int]map[string]uint64      // tid -> key -> commitTS observed at read time
+	writeSet  map[int]map[string]interface{} // tid -> key -> pending value
+	writeBase map[int]map[string]uint64      // tid -> key -> commitTS observed before the write
+
+	// RAMP metadata: the running bloom filter of every key a txn has
+	// written so far, stamped onto each version it commits. See ramp.go.
+	writeBloom map[int]uint64
+
+	// Commit queue: only blocks a subtransaction's Prepare while its keys
+	// overlap an in-flight one's; waiters are not admitted in arrival
+	// order. See commitqueue.go.
+	cqMu       sync.Mutex
+	cqCond     *sync.Cond
+	queueDepth int             // subtids currently waiting for a key conflict to clear
+	writers    map[string]int  // key -> # in-flight subtids writing it
+	cqAdmitted map[txnKey]bool // subtid -> true once its counters have been bumped
+	waitCount  int             // admissions that had to wait, for Stats
+	waitTotal  time.Duration   // cumulative wait time, for Stats
 }
 
 // helper struct to simplify logged ops
 type Operation struct {
-	OpType string
-	Key    string
-	Value  interface{}
+	OpType  string
+	Key     string
+	Value   interface{}
+	StartTS uint64 // snapshot timestamp a "get" should resolve against
+}
+
+// assignStartTSLocked returns tid's startTS, assigning the next clock value
+// the first time tid is seen. Callers must hold sv.mu.
+func (sv *Server) assignStartTSLocked(tid int) uint64 {
+	if ts, ok := sv.startTS[tid]; ok {
+		return ts
+	}
+	sv.nextTS++
+	ts := sv.nextTS
+	sv.startTS[tid] = ts
+	return ts
+}
+
+// resolve returns the value and commitTS of the latest version in item's
+// chain committed at or before startTS.
+func resolve(item *StoreItem, startTS uint64) (interface{}, uint64) {
+	var val interface{}
+	var ts uint64
+	for _, v := range item.versions {
+		if v.commitTS > startTS {
+			break
+		}
+		val, ts = v.value, v.commitTS
+	}
+	return val, ts
 }
 
 // Prepare handler
 //
 // This function should:
-// 1. Attempt to obtain locks for the given transaction
+// 1. Attempt to obtain write locks for the keys this subtransaction sets
 // 2. If this succeeds, vote Yes
 // 3. If this fails, release any obtained locks and vote No
+//
+// Reads never take a lock here: Commit resolves them against the key's
+// version chain using the snapshot timestamp recorded when they were logged.
 func (sv *Server) Prepare(args *RPCArgs, reply *PrepareReply) {
 	sv.mu.Lock()
-	ops, ok := sv.txnLogs[args.Tid]
-	curState := sv.txnState[args.Tid]
+	mode := sv.txnMode[args.Tid]
+	key := txnKey{Tid: args.Tid, Subtid: args.Subtid}
+	ops, ok := sv.txnLogs[key]
+	curState := sv.txnState[key]
 	sv.mu.Unlock()
 
+	if mode == Optimistic {
+		sv.prepareOptimistic(args, reply)
+		return
+	}
+
 	// check relevancy first
 	if !ok {
 		reply.Relevant = false
@@ -47,6 +148,10 @@ func (sv *Server) Prepare(args *RPCArgs, reply *PrepareReply) {
 	// if no short circuit this is relevant
 	reply.Relevant = true
 
+	// persist what we're about to attempt before doing anything observable,
+	// so a crash mid-Prepare can still be replayed
+	sv.wal.AppendPrepare(args.Tid, args.Subtid, ops)
+
 	// already voted yes or is pre-committed or committed → just vote yes again
 	if curState == stateVotedYes || curState == statePreCommitted || curState == stateCommitted {
 		reply.VoteYes = true
@@ -59,93 +164,144 @@ func (sv *Server) Prepare(args *RPCArgs, reply *PrepareReply) {
 		return
 	}
 
-	// lock all the keys used in this transaction
-	lockedKeys := []string{}
-	success := true
+	// wait in the commit queue until none of this subtid's keys overlap an
+	// in-flight one's, so the lock attempts below are expected to succeed
+	// rather than racing other Prepares for the same keys
+	if !sv.admitCommitQueue(key, ops) {
+		sv.mu.Lock()
+		sv.txnState[key] = stateVotedNo
+		sv.mu.Unlock()
 
-	for _, op := range ops {
-		item, exists := sv.store[op.Key]
-		if !exists {
-			success = false
-			break
-		}
-		if op.OpType == "get" {
-			ok := item.lock.TryRLock()
-			if !ok {
-				success = false
-				break
-			}
-		} else if op.OpType == "set" {
-			ok := item.lock.TryLock()
-			if !ok {
-				success = false
-				break
-			}
-		} else {
-			continue
-		}
-		lockedKeys = append(lockedKeys, op.Key)
+		sv.wal.AppendVote(args.Tid, args.Subtid, false, false, nil)
+		reply.VoteYes = false
+		return
 	}
 
-	// if ANY can not be locked. release all
-	if !success {
-		for _, key := range lockedKeys {
-			item := sv.store[key]
-			// unlock according to operation type (lock type basically)
-			for _, op := range ops {
-				if op.Key == key {
-					if op.OpType == "get" {
-						item.lock.RUnlock()
-					} else if op.OpType == "set" {
-						item.lock.Unlock()
-					}
-				}
-			}
+	// only "set" ops need a write lock; "get" ops resolve against the
+	// version chain at Commit time and never block on it. Acquire them on
+	// a cancellable goroutine so a concurrent Stop can interrupt a Prepare
+	// that's starving on a hot key instead of leaving it stuck forever.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	sv.mu.Lock()
+	sv.txnCtx[key] = pendingPrepare{cancel: cancel, done: done}
+	sv.mu.Unlock()
+
+	var lockedKeys []string
+	var success bool
+	go func() {
+		lockedKeys, success = sv.lockKeysCtx(ctx, ops)
+		close(done)
+	}()
+	<-done
+	cancel()
+
+	// Check whether a concurrent Stop already decided this subtid and
+	// record state/heldLocks for a success in the SAME critical section
+	// as that check - otherwise Stop could land in the gap between them,
+	// see us holding no locks yet, report itself done, and then have us
+	// overwrite its stateAborted with stateVotedYes right after.
+	sv.mu.Lock()
+	delete(sv.txnCtx, key)
+	stopped := sv.txnState[key] == stateAborted
+
+	if !success || stopped {
+		sv.mu.Unlock()
+
+		for _, k := range lockedKeys {
+			sv.store[k].mu.Unlock()
 		}
+		sv.releaseCommitQueue(key, ops)
 
 		sv.mu.Lock()
-		sv.txnState[args.Tid] = stateVotedNo
+		if sv.txnState[key] != stateAborted {
+			sv.txnState[key] = stateVotedNo
+		}
 		sv.mu.Unlock()
 
+		sv.wal.AppendVote(args.Tid, args.Subtid, false, false, nil)
 		reply.VoteYes = false
 		return
 	}
 
 	// at this point this is a success, and we should record state and locks
-	sv.mu.Lock()
-	sv.txnState[args.Tid] = stateVotedYes
-	sv.heldLocks[args.Tid] = lockedKeys
+	sv.txnState[key] = stateVotedYes
+	sv.heldLocks[key] = lockedKeys
 	sv.mu.Unlock()
 
+	sv.wal.AppendVote(args.Tid, args.Subtid, true, false, nil)
 	reply.VoteYes = true
 }
 
+// lockKeysCtx takes a write lock on every "set" key in ops, retrying a busy
+// lock until it's free or ctx is cancelled. It returns the keys it managed
+// to lock and whether every one of them was acquired.
+func (sv *Server) lockKeysCtx(ctx context.Context, ops []Operation) ([]string, bool) {
+	lockedKeys := []string{}
+	for _, op := range ops {
+		if op.OpType != "set" {
+			continue
+		}
+		item, exists := sv.store[op.Key]
+		if !exists || !tryLockCtx(ctx, &item.mu) {
+			return lockedKeys, false
+		}
+		lockedKeys = append(lockedKeys, op.Key)
+	}
+	return lockedKeys, true
+}
+
+// lockRetryInterval paces lockKeysCtx's busy-lock retries.
+const lockRetryInterval = 2 * time.Millisecond
+
+// tryLockCtx retries mu.TryLock until it succeeds or ctx is cancelled.
+func tryLockCtx(ctx context.Context, mu *sync.Mutex) bool {
+	for {
+		if mu.TryLock() {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
+
 // Abort handler
 //
-// This function should abort the given transaction
-// Make sure to release any held locks
+// This function should abort the given subtransaction and release only its
+// own locks - the rest of Tid's subtransactions are unaffected.
 func (sv *Server) Abort(args *RPCArgs, reply *struct{}) {
 	sv.mu.Lock()
-	lockedKeys := sv.heldLocks[args.Tid]
-	ops := sv.txnLogs[args.Tid] // grab ops once here
-	delete(sv.heldLocks, args.Tid)
-	sv.txnState[args.Tid] = stateAborted
+	mode := sv.txnMode[args.Tid]
+	key := txnKey{Tid: args.Tid, Subtid: args.Subtid}
+	lockedKeys := sv.heldLocks[key]
+	ops := sv.txnLogs[key]
+	delete(sv.heldLocks, key)
+	sv.txnState[key] = stateAborted
+
+	// Optimistic transactions don't use subtransactions, so aborting one
+	// is equivalent to aborting the whole Tid: drop its read/write set too.
+	// No lock cleanup is needed there either - it never took any.
+	if mode == Optimistic {
+		delete(sv.startTS, args.Tid)
+		delete(sv.readSet, args.Tid)
+		delete(sv.writeSet, args.Tid)
+		delete(sv.writeBase, args.Tid)
+		delete(sv.writeBloom, args.Tid)
+		delete(sv.txnMode, args.Tid)
+		delete(sv.isolation, args.Tid)
+	}
 	sv.mu.Unlock()
 
-	for _, key := range lockedKeys {
-		item := sv.store[key]
+	sv.wal.AppendAbort(args.Tid, args.Subtid)
 
-		for _, op := range ops {
-			if op.Key != key {
-				continue
-			}
-			if op.OpType == "get" {
-				item.lock.RUnlock()
-			} else if op.OpType == "set" {
-				item.lock.Unlock()
-			}
-		}
+	for _, k := range lockedKeys {
+		sv.store[k].mu.Unlock()
 	}
+	sv.releaseCommitQueue(key, ops)
 }
 
 // Query handler
@@ -156,8 +312,10 @@ func (sv *Server) Query(args struct{}, reply *QueryReply) {
 	defer sv.mu.Unlock()
 
 	reply.Transactions = make(map[int]TransactionState) // essentially a map copy to transactions field
-	for tid, state := range sv.txnState {
-		reply.Transactions[tid] = state
+	// a Tid may have several subtids in flight at once; report whichever
+	// one this iteration happens to see last for that Tid
+	for key, state := range sv.txnState {
+		reply.Transactions[key.Tid] = state
 	}
 }
 
@@ -166,82 +324,144 @@ func (sv *Server) Query(args struct{}, reply *QueryReply) {
 // This function should confirm that the server is ready to commit
 func (sv *Server) PreCommit(args *RPCArgs, reply *struct{}) {
 	sv.mu.Lock()
-	defer sv.mu.Unlock()
+	sv.txnState[txnKey{Tid: args.Tid, Subtid: args.Subtid}] = statePreCommitted
+	sv.mu.Unlock()
 
-	sv.txnState[args.Tid] = statePreCommitted
+	sv.wal.AppendPreCommit(args.Tid, args.Subtid)
 }
 
 // Commit handler
 //
-// This function should actually apply the logged operations
-// Make sure to release any held locks
+// This function commits one subtransaction: its ops are appended to Tid's
+// durable finalOps list (not yet applied to the store), and its write locks
+// move to finalLocks rather than being released - they stay held until
+// Finalize actually applies or discards them, preserving lock-based
+// serialization across the handoff.
 func (sv *Server) Commit(args *RPCArgs, reply *CommitReply) {
-	reply.GetResults = make(map[string]interface{})
+	reply.GetResults = make(map[string]VersionedValue)
 
 	sv.mu.Lock()
-	ops := sv.txnLogs[args.Tid]
-	curState := sv.txnState[args.Tid]
-	lockedKeys := sv.heldLocks[args.Tid] // to make it more idempotent
+	mode := sv.txnMode[args.Tid]
+	if mode == Optimistic {
+		sv.commitOptimisticLocked(args.Tid)
+		sv.mu.Unlock()
+		return
+	}
 
-	// if not already committed, apply writes and log the commits
+	key := txnKey{Tid: args.Tid, Subtid: args.Subtid}
+	ops := sv.txnLogs[key]
+	curState := sv.txnState[key]
+	lockedKeys := sv.heldLocks[key] // to make it more idempotent
+
+	// if not already committed, hand this subtid's ops and locks to Tid's
+	// durable accumulated lists for Finalize to apply/release
 	if curState != stateCommitted {
-		for _, op := range ops {
-			if op.OpType == "set" {
-				sv.store[op.Key].value = op.Value
-			}
-		}
-		sv.txnState[args.Tid] = stateCommitted
-		delete(sv.heldLocks, args.Tid)
+		sv.finalOps[args.Tid] = append(sv.finalOps[args.Tid], ops...)
+		sv.finalLocks[args.Tid] = append(sv.finalLocks[args.Tid], lockedKeys...)
+		sv.txnState[key] = stateCommitted
+		delete(sv.heldLocks, key)
 	}
 
 	for _, op := range ops {
-		if op.OpType == "get" {
-			reply.GetResults[op.Key] = sv.store[op.Key].value
+		if op.OpType != "get" {
+			continue
 		}
+		val, ts := resolve(sv.store[op.Key], op.StartTS)
+		reply.GetResults[op.Key] = VersionedValue{Value: val, CommitTS: ts}
 	}
 	sv.mu.Unlock()
 
-	// we will then release any held locks only if we JUST committed
 	if curState != stateCommitted {
-		for _, key := range lockedKeys {
-			item := sv.store[key]
-			for _, op := range ops {
-				if op.Key != key {
-					continue
-				}
-				if op.OpType == "get" {
-					item.lock.RUnlock()
-				} else if op.OpType == "set" {
-					item.lock.Unlock()
-				}
+		sv.wal.AppendCommit(args.Tid, args.Subtid)
+	}
+	sv.releaseCommitQueue(key, ops)
+}
+
+// Finalize handler
+//
+// This function applies (or discards) every committed subtid's ops for Tid
+// as a single atomic batch of new MVCC versions, and retires Tid.
+func (sv *Server) Finalize(args *FinalizeArgs, reply *struct{}) {
+	sv.mu.Lock()
+
+	ops := sv.finalOps[args.Tid]
+	bloom := sv.writeBloom[args.Tid]
+	lockedKeys := sv.finalLocks[args.Tid]
+
+	sv.wal.AppendFinalize(args.Tid, ops, args.Apply, bloom)
+
+	if args.Apply && len(ops) > 0 {
+		sv.nextTS++
+		commitTS := sv.nextTS
+		for _, op := range ops {
+			if op.OpType != "set" {
+				continue
 			}
+			item := sv.store[op.Key]
+			item.versions = append(item.versions, version{value: op.Value, commitTS: commitTS, txnID: args.Tid, siblingsBloom: bloom})
 		}
+
+		sv.walCommits++
+		if sv.walCommits >= snapshotInterval {
+			sv.wal.AppendSnapshot(sv.snapshotValuesLocked())
+			sv.walCommits = 0
+		}
+	}
+
+	delete(sv.finalOps, args.Tid)
+	delete(sv.finalLocks, args.Tid)
+	delete(sv.startTS, args.Tid)
+	delete(sv.writeBloom, args.Tid)
+	sv.mu.Unlock()
+
+	// only now - once Finalize has actually decided - are this Tid's write
+	// locks from Commit safe to release
+	for _, k := range lockedKeys {
+		sv.store[k].mu.Unlock()
 	}
 }
 
+// snapshotValuesLocked returns every key's latest resolved value, for a WAL
+// checkpoint. Callers must hold sv.mu.
+func (sv *Server) snapshotValuesLocked() map[string]interface{} {
+	values := make(map[string]interface{}, len(sv.store))
+	for key, item := range sv.store {
+		if val, _ := resolve(item, sv.nextTS); val != nil {
+			values[key] = val
+		}
+	}
+	return values
+}
+
 // Get
 //
-// This function should log a Get operation
-func (sv *Server) Get(tid int, key string) {
+// This function should log a Get operation for subtid, snapshotted at the
+// transaction's startTS so Commit can resolve it without locking.
+func (sv *Server) Get(tid int, subtid int, key string) {
 	sv.mu.Lock()
 	defer sv.mu.Unlock()
 
-	// log the for op for this transaction
-	sv.txnLogs[tid] = append(sv.txnLogs[tid], Operation{
-		OpType: "get",
-		Key:    key,
+	startTS := sv.assignStartTSLocked(tid)
+	k := txnKey{Tid: tid, Subtid: subtid}
+	sv.txnLogs[k] = append(sv.txnLogs[k], Operation{
+		OpType:  "get",
+		Key:     key,
+		StartTS: startTS,
 	})
 }
 
 // Set
 //
-// This function should log a Set operation
-func (sv *Server) Set(tid int, key string, value interface{}) {
+// This function should log a Set operation for subtid
+func (sv *Server) Set(tid int, subtid int, key string, value interface{}) {
 	sv.mu.Lock()
 	defer sv.mu.Unlock()
 
-	// log the set op for this transaction
-	sv.txnLogs[tid] = append(sv.txnLogs[tid], Operation{
+	sv.assignStartTSLocked(tid)
+	sv.writeBloom[tid] = bloomAdd(sv.writeBloom[tid], key)
+	// log the set op for this subtransaction
+	k := txnKey{Tid: tid, Subtid: subtid}
+	sv.txnLogs[k] = append(sv.txnLogs[k], Operation{
 		OpType: "set", // same idea as above use the ds to maintain maps
 		Key:    key,
 		Value:  value,
@@ -249,19 +469,66 @@ func (sv *Server) Set(tid int, key string, value interface{}) {
 }
 
 // Initialize new Server
-// keys is a slice of the keys that this server is responsible for storing
-func MakeServer(keys []string) *Server {
+// keys is a slice of the keys that this server is responsible for storing.
+// walPath is where the durable write-ahead log lives; an empty walPath
+// leaves the Server unable to recover state across a restart. If a log
+// already exists at walPath, MakeServer replays it to reconstruct txnLogs,
+// txnState and heldLocks before returning.
+func MakeServer(keys []string, walPath string) *Server {
 	store := make(map[string]*StoreItem)
 	for _, key := range keys {
 		store[key] = &StoreItem{} // each key will begin w/ an empty StoreItem
 	}
 
 	sv := &Server{
-		store:     store,
-		txnLogs:   make(map[int][]Operation),
-		txnState:  make(map[int]TransactionState),
-		heldLocks: make(map[int][]string),
+		store:      store,
+		txnLogs:    make(map[txnKey][]Operation),
+		txnState:   make(map[txnKey]TransactionState),
+		heldLocks:  make(map[txnKey][]string),
+		finalOps:   make(map[int][]Operation),
+		finalLocks: make(map[int][]string),
+		startTS:    make(map[int]uint64),
+		gcStop:     make(chan struct{}),
+		txnCtx:     make(map[txnKey]pendingPrepare),
+		txnMode:    make(map[int]TxnMode),
+		isolation:  make(map[int]Isolation),
+		readSet:    make(map[int]map[string]uint64),
+		writeSet:   make(map[int]map[string]interface{}),
+		writeBase:  make(map[int]map[string]uint64),
+		writeBloom: make(map[int]uint64),
+		writers:    make(map[string]int),
+		cqAdmitted: make(map[txnKey]bool),
+	}
+	sv.cqCond = sync.NewCond(&sv.cqMu)
+
+	if walPath == "" {
+		sv.wal = noopLogger{}
+	} else {
+		logger, err := newFileLogger(walPath)
+		if err != nil {
+			panic(err)
+		}
+		sv.wal = logger
+
+		records, err := sv.wal.Replay()
+		if err != nil {
+			panic(err)
+		}
+		sv.recoverFromWAL(records)
 	}
 
+	go sv.gcLoop()
+
 	return sv
 }
+
+// Close stops the background version GC and closes the WAL, if one is
+// open. Safe to call more than once.
+func (sv *Server) Close() error {
+	var err error
+	sv.closeOnce.Do(func() {
+		close(sv.gcStop)
+		err = sv.wal.Close()
+	})
+	return err
+}
@@ -0,0 +1,182 @@
+package commit
+
+// GetOptimistic reads key for tid via the optimistic (STM) path: it records
+// the key and the commitTS it was resolved at into tid's read set instead of
+// taking a read lock. isolation is pinned the first time tid is seen and
+// governs how Prepare later validates this transaction.
+func (sv *Server) GetOptimistic(tid int, key string, isolation Isolation) interface{} {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	sv.txnMode[tid] = Optimistic
+	if _, ok := sv.isolation[tid]; !ok {
+		sv.isolation[tid] = isolation
+	}
+
+	// Resolve against tid's pinned startTS, not the live clock, so every
+	// read this tid makes comes from the same snapshot - otherwise two
+	// Gets from the same tid could observe different points in time if
+	// another transaction committed in between.
+	startTS := sv.assignStartTSLocked(tid)
+	item := sv.store[key]
+	val, ts := resolve(item, startTS)
+
+	if sv.readSet[tid] == nil {
+		sv.readSet[tid] = make(map[string]uint64)
+	}
+	sv.readSet[tid][key] = ts
+
+	return val
+}
+
+// SetOptimistic buffers value for key into tid's write set. The write is
+// not visible to other transactions until Commit.
+func (sv *Server) SetOptimistic(tid int, key string, value interface{}) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	sv.txnMode[tid] = Optimistic
+
+	// Same snapshot as GetOptimistic - a write's base ts must come from
+	// tid's pinned startTS too, or validation could compare it against a
+	// write made before tid's first read.
+	startTS := sv.assignStartTSLocked(tid)
+	if sv.writeSet[tid] == nil {
+		sv.writeSet[tid] = make(map[string]interface{})
+		sv.writeBase[tid] = make(map[string]uint64)
+	}
+	sv.writeSet[tid][key] = value
+	sv.writeBloom[tid] = bloomAdd(sv.writeBloom[tid], key)
+	if _, seen := sv.writeBase[tid][key]; !seen {
+		_, ts := resolve(sv.store[key], startTS)
+		sv.writeBase[tid][key] = ts
+	}
+}
+
+// prepareOptimistic validates tid's read (and, for Serializable, write) set
+// against the current version chain instead of acquiring locks. No lock
+// cleanup is ever needed on the optimistic path: a failed validation just
+// votes no and leaves the txn entry to be dropped by Abort.
+func (sv *Server) prepareOptimistic(args *RPCArgs, reply *PrepareReply) {
+	sv.mu.Lock()
+
+	// A participant that only ever saw SetOptimistic calls for this tid
+	// never learned the coordinator's chosen isolation locally - pin it
+	// from args here too, same first-write-wins rule as GetOptimistic.
+	if _, ok := sv.isolation[args.Tid]; !ok {
+		sv.isolation[args.Tid] = args.Isolation
+	}
+
+	// Optimistic transactions don't use subtransactions, so they always
+	// live at subtid 0.
+	key := txnKey{Tid: args.Tid}
+	curState := sv.txnState[key]
+	if curState == stateVotedYes || curState == statePreCommitted || curState == stateCommitted {
+		sv.mu.Unlock()
+		reply.Relevant = true
+		reply.VoteYes = true
+		sv.wal.AppendVote(args.Tid, 0, true, true, nil)
+		return
+	}
+	if curState == stateVotedNo || curState == stateAborted {
+		sv.mu.Unlock()
+		reply.Relevant = true
+		reply.VoteYes = false
+		sv.wal.AppendVote(args.Tid, 0, false, true, nil)
+		return
+	}
+
+	_, hasReads := sv.readSet[args.Tid]
+	_, hasWrites := sv.writeSet[args.Tid]
+	if !hasReads && !hasWrites {
+		sv.mu.Unlock()
+		reply.Relevant = false
+		reply.VoteYes = false
+		return
+	}
+	reply.Relevant = true
+
+	voteYes := sv.validateOptimisticLocked(args.Tid)
+	if voteYes {
+		sv.txnState[key] = stateVotedYes
+	} else {
+		sv.txnState[key] = stateVotedNo
+	}
+
+	// A yes vote is the point tid's buffered write set must become
+	// durable: a crash between this VotedYes and the coordinator's
+	// follow-up Commit must not lose it.
+	var voteOps []Operation
+	if voteYes {
+		for k, val := range sv.writeSet[args.Tid] {
+			voteOps = append(voteOps, Operation{OpType: "set", Key: k, Value: val})
+		}
+	}
+	sv.mu.Unlock()
+
+	sv.wal.AppendVote(args.Tid, 0, voteYes, true, voteOps)
+	reply.VoteYes = voteYes
+}
+
+// validateOptimisticLocked reports whether every key tid read still has the
+// commitTS it observed, and - under Serializable isolation - that every key
+// tid is about to write hasn't picked up a newer commit either (guarding
+// against write-set phantoms). Callers must hold sv.mu.
+func (sv *Server) validateOptimisticLocked(tid int) bool {
+	for key, observedTS := range sv.readSet[tid] {
+		if _, curTS := resolve(sv.store[key], sv.nextTS); curTS != observedTS {
+			return false
+		}
+	}
+
+	if sv.isolation[tid] == Serializable {
+		for key, baseTS := range sv.writeBase[tid] {
+			if _, curTS := resolve(sv.store[key], sv.nextTS); curTS != baseTS {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// commitOptimisticLocked applies tid's buffered writes as a single new
+// version per key and clears its read/write set. Callers must hold sv.mu.
+//
+// An Optimistic transaction has no separate Finalize step - this is its
+// one and only terminal decision point - so it logs via AppendFinalize
+// directly rather than AppendCommit, the same record Finalize uses, so
+// recoverFromWAL can replay it the same way.
+func (sv *Server) commitOptimisticLocked(tid int) {
+	key := txnKey{Tid: tid}
+	if sv.txnState[key] != stateCommitted {
+		var ops []Operation
+		bloom := sv.writeBloom[tid]
+		if writes := sv.writeSet[tid]; len(writes) > 0 {
+			sv.nextTS++
+			commitTS := sv.nextTS
+			for k, val := range writes {
+				item := sv.store[k]
+				item.versions = append(item.versions, version{value: val, commitTS: commitTS, txnID: tid, siblingsBloom: bloom})
+				ops = append(ops, Operation{OpType: "set", Key: k, Value: val})
+			}
+		}
+
+		sv.wal.AppendFinalize(tid, ops, true, bloom)
+		if len(ops) > 0 {
+			sv.walCommits++
+			if sv.walCommits >= snapshotInterval {
+				sv.wal.AppendSnapshot(sv.snapshotValuesLocked())
+				sv.walCommits = 0
+			}
+		}
+
+		sv.txnState[key] = stateCommitted
+		delete(sv.startTS, tid)
+	}
+
+	delete(sv.readSet, tid)
+	delete(sv.writeSet, tid)
+	delete(sv.writeBase, tid)
+	delete(sv.writeBloom, tid)
+}
@@ -0,0 +1,45 @@
+package commit
+
+import "testing"
+
+// TestOptimisticIsolationLevels exercises the one real behavioral
+// difference between the two remaining Isolation levels: Serializable
+// rejects a transaction whose write set picked up a commit it didn't
+// see, SerializableSnapshot does not.
+func TestOptimisticIsolationLevels(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		isolation  Isolation
+		wantVoteNo bool
+	}{
+		{"SerializableSnapshot ignores write-set phantom", SerializableSnapshot, false},
+		{"Serializable catches write-set phantom", Serializable, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sv := MakeServer([]string{"a", "b"}, "")
+
+			sv.GetOptimistic(1, "a", tc.isolation)
+			sv.SetOptimistic(1, "b", "tid1-write")
+
+			// An unrelated transaction commits a write to "b" - a key tid 1
+			// is about to write but never read - in between tid 1's Set and
+			// its Prepare.
+			sv.SetOptimistic(2, "b", "tid2-write")
+			var prepReply2 PrepareReply
+			sv.Prepare(&RPCArgs{Tid: 2, Isolation: SerializableSnapshot}, &prepReply2)
+			if !prepReply2.VoteYes {
+				t.Fatalf("tid 2 should prepare cleanly, got VoteYes=false")
+			}
+			var commitReply2 CommitReply
+			sv.Commit(&RPCArgs{Tid: 2}, &commitReply2)
+
+			var prepReply1 PrepareReply
+			sv.Prepare(&RPCArgs{Tid: 1, Isolation: tc.isolation}, &prepReply1)
+
+			gotVoteNo := !prepReply1.VoteYes
+			if gotVoteNo != tc.wantVoteNo {
+				t.Fatalf("tid 1 VoteYes=%v, want voteNo=%v", prepReply1.VoteYes, tc.wantVoteNo)
+			}
+		})
+	}
+}
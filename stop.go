@@ -0,0 +1,46 @@
+package commit
+
+import "context"
+
+// pendingPrepare is the cancellation handle for one subtid's in-flight
+// Prepare: cancel interrupts its lock acquisition, done closes once the
+// Prepare goroutine has actually returned.
+type pendingPrepare struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Stop handler
+//
+// This function cancels subtid's in-flight Prepare, if any, and marks it
+// aborted, releasing any locks it had partially (or fully) acquired. This
+// is the only way to unstick a Prepare that's starving on a hot key.
+// Stop does not wake a Prepare still waiting in the commit queue: that
+// Prepare sees the abort, releases what it took and votes no only once it
+// has been admitted and has finished acquiring its locks.
+func (sv *Server) Stop(args *RPCArgs, reply *struct{}) {
+	key := txnKey{Tid: args.Tid, Subtid: args.Subtid}
+
+	sv.mu.Lock()
+	pending, inFlight := sv.txnCtx[key]
+	sv.mu.Unlock()
+
+	if inFlight {
+		pending.cancel()
+		<-pending.done // wait for the Prepare goroutine to notice and return
+	}
+
+	sv.mu.Lock()
+	lockedKeys := sv.heldLocks[key]
+	ops := sv.txnLogs[key]
+	delete(sv.heldLocks, key)
+	sv.txnState[key] = stateAborted
+	sv.mu.Unlock()
+
+	sv.wal.AppendAbort(args.Tid, args.Subtid)
+
+	for _, k := range lockedKeys {
+		sv.store[k].mu.Unlock()
+	}
+	sv.releaseCommitQueue(key, ops)
+}
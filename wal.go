@@ -0,0 +1,328 @@
+package commit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"os"
+	"sync"
+)
+
+// RecordType distinguishes the durable records a Logger can append.
+type RecordType int
+
+const (
+	RecordPrepare RecordType = iota
+	RecordVote
+	RecordPreCommit
+	RecordCommit
+	RecordAbort
+	RecordFinalize
+	RecordSnapshot
+)
+
+// Record is one durable WAL entry. Which fields are meaningful depends on
+// Type: RecordPrepare and RecordFinalize carry Ops, RecordVote carries
+// VoteYes and Optimistic (true for a vote from the STM path) and, for an
+// Optimistic yes vote, the buffered write set in Ops too (so it survives a
+// crash before the follow-up Commit), RecordFinalize also carries Apply
+// and Bloom, and RecordSnapshot carries Values; the others are identified
+// by Tid/Subtid alone.
+type Record struct {
+	Type       RecordType
+	Tid        int
+	Subtid     int
+	Ops        []Operation
+	VoteYes    bool
+	Optimistic bool                   // RecordVote: true if this vote came from the Optimistic (STM) path
+	Apply      bool                   // RecordFinalize: whether Ops were applied or discarded
+	Bloom      uint64                 // RecordFinalize: Tid's writeBloom, for re-stamping siblingsBloom
+	Values     map[string]interface{} // RecordSnapshot: key -> latest committed value
+}
+
+// Logger durably persists every 3PC state transition so a Server can
+// recover its in-memory state after a crash without breaking 3PC safety.
+type Logger interface {
+	AppendPrepare(tid, subtid int, ops []Operation) error
+	// AppendVote records a Prepare decision. optimistic must be true for a
+	// vote from the STM path and false for the lock-based path - Replay
+	// has no other reliable way to tell a read-only Optimistic tid (whose
+	// ops is always empty) apart from a Pessimistic subtid. ops is nil
+	// except for an Optimistic yes vote, where it's tid's buffered write
+	// set - otherwise a crash between a durable VotedYes and the
+	// coordinator's follow-up Commit would lose the write with no way to
+	// replay it.
+	AppendVote(tid, subtid int, yes bool, optimistic bool, ops []Operation) error
+	AppendPreCommit(tid, subtid int) error
+	AppendCommit(tid, subtid int) error
+	AppendAbort(tid, subtid int) error
+	// AppendFinalize records Tid's terminal decision - the ops it actually
+	// applied (or discarded) to the store, and the bloom used to stamp
+	// them - so a crash between Finalize applying a write and the next
+	// snapshot doesn't lose it on replay.
+	AppendFinalize(tid int, ops []Operation, apply bool, bloom uint64) error
+	// AppendSnapshot records a checkpoint of every key's latest committed
+	// value, so recovery only re-applies the Finalize records written after
+	// the most recent one. Replay still reads the whole log.
+	AppendSnapshot(values map[string]interface{}) error
+	Replay() ([]Record, error)
+	Close() error
+}
+
+// snapshotInterval is how many applied commits a Server lets accumulate
+// before writing a new RecordSnapshot, bounding how many Finalize records
+// recovery has to re-apply.
+const snapshotInterval = 64
+
+// noopLogger is used when MakeServer is given no WAL path - a Server still
+// works, it just can't recover state across a restart.
+type noopLogger struct{}
+
+func (noopLogger) AppendPrepare(tid, subtid int, ops []Operation) error { return nil }
+func (noopLogger) AppendVote(tid, subtid int, yes bool, optimistic bool, ops []Operation) error {
+	return nil
+}
+func (noopLogger) AppendPreCommit(tid, subtid int) error { return nil }
+func (noopLogger) AppendCommit(tid, subtid int) error                   { return nil }
+func (noopLogger) AppendAbort(tid, subtid int) error                    { return nil }
+func (noopLogger) AppendFinalize(tid int, ops []Operation, apply bool, bloom uint64) error {
+	return nil
+}
+func (noopLogger) AppendSnapshot(values map[string]interface{}) error { return nil }
+func (noopLogger) Replay() ([]Record, error)                            { return nil, nil }
+func (noopLogger) Close() error                                         { return nil }
+
+// fileLogger is the default Logger: length-prefixed gob records, fsynced
+// after every append.
+type fileLogger struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func newFileLogger(path string) (*fileLogger, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileLogger{file: file}, nil
+}
+
+func (l *fileLogger) append(rec Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(rec); err != nil {
+		return err
+	}
+
+	var lenPrefix [4]byte
+	binary.BigEndian.PutUint32(lenPrefix[:], uint32(buf.Len()))
+
+	if _, err := l.file.Write(lenPrefix[:]); err != nil {
+		return err
+	}
+	if _, err := l.file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+func (l *fileLogger) AppendPrepare(tid, subtid int, ops []Operation) error {
+	return l.append(Record{Type: RecordPrepare, Tid: tid, Subtid: subtid, Ops: ops})
+}
+
+func (l *fileLogger) AppendVote(tid, subtid int, yes bool, optimistic bool, ops []Operation) error {
+	return l.append(Record{Type: RecordVote, Tid: tid, Subtid: subtid, VoteYes: yes, Optimistic: optimistic, Ops: ops})
+}
+
+func (l *fileLogger) AppendPreCommit(tid, subtid int) error {
+	return l.append(Record{Type: RecordPreCommit, Tid: tid, Subtid: subtid})
+}
+
+func (l *fileLogger) AppendCommit(tid, subtid int) error {
+	return l.append(Record{Type: RecordCommit, Tid: tid, Subtid: subtid})
+}
+
+func (l *fileLogger) AppendAbort(tid, subtid int) error {
+	return l.append(Record{Type: RecordAbort, Tid: tid, Subtid: subtid})
+}
+
+func (l *fileLogger) AppendFinalize(tid int, ops []Operation, apply bool, bloom uint64) error {
+	return l.append(Record{Type: RecordFinalize, Tid: tid, Ops: ops, Apply: apply, Bloom: bloom})
+}
+
+func (l *fileLogger) AppendSnapshot(values map[string]interface{}) error {
+	return l.append(Record{Type: RecordSnapshot, Values: values})
+}
+
+// Replay reads every record back in append order.
+func (l *fileLogger) Replay() ([]Record, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, err := l.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	var records []Record
+	r := bufio.NewReader(l.file)
+	for {
+		var lenPrefix [4]byte
+		if _, err := io.ReadFull(r, lenPrefix[:]); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		data := make([]byte, binary.BigEndian.Uint32(lenPrefix[:]))
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+
+		var rec Record
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&rec); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+
+	_, err := l.file.Seek(0, io.SeekEnd)
+	return records, err
+}
+
+func (l *fileLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// recoverFromWAL replays records to reconstruct txnLogs, txnState, finalOps
+// and the store's version chains, then re-acquires write locks for any
+// subtid still VotedYes or PreCommitted (so the coordinator's termination
+// protocol can keep driving it) and for any Tid that committed but whose
+// Finalize never ran (so its locks stay held exactly as Commit left them).
+func (sv *Server) recoverFromWAL(records []Record) {
+	// The most recent snapshot seeds the store, so Finalize records written
+	// before it are not re-applied. Every other record is still replayed, so
+	// subtids that were in flight when the snapshot was taken are recovered.
+	snapshot := -1
+	for i, rec := range records {
+		if rec.Type == RecordSnapshot {
+			snapshot = i
+		}
+	}
+	if snapshot >= 0 {
+		sv.nextTS++
+		commitTS := sv.nextTS
+		for k, v := range records[snapshot].Values {
+			if item, ok := sv.store[k]; ok {
+				item.versions = append(item.versions, version{value: v, commitTS: commitTS, txnID: -1})
+			}
+		}
+	}
+
+	finalized := make(map[int]bool)
+	for i, rec := range records {
+		key := txnKey{Tid: rec.Tid, Subtid: rec.Subtid}
+		switch rec.Type {
+		case RecordPrepare:
+			sv.txnLogs[key] = rec.Ops
+		case RecordVote:
+			if rec.VoteYes {
+				sv.txnState[key] = stateVotedYes
+			} else {
+				sv.txnState[key] = stateVotedNo
+			}
+			// A yes vote from the Optimistic path must restore txnMode so a
+			// Commit arriving after this restart still finds mode
+			// Optimistic instead of falling through to the Pessimistic
+			// branch with nothing to commit - checked via Optimistic, not
+			// len(rec.Ops), since a read-only Optimistic tid's vote always
+			// has an empty Ops and would otherwise be indistinguishable
+			// from a Pessimistic one. When Ops is non-empty it's tid's
+			// buffered write set; restore writeSet/writeBloom from it too.
+			// writeBase isn't restored: it's only consulted during
+			// Prepare-time validation, and that decision is already
+			// durably made.
+			if rec.VoteYes && rec.Optimistic {
+				sv.txnMode[rec.Tid] = Optimistic
+				if len(rec.Ops) > 0 {
+					writeSet := make(map[string]interface{}, len(rec.Ops))
+					var bloom uint64
+					for _, op := range rec.Ops {
+						writeSet[op.Key] = op.Value
+						bloom = bloomAdd(bloom, op.Key)
+					}
+					sv.writeSet[rec.Tid] = writeSet
+					sv.writeBloom[rec.Tid] = bloom
+				}
+			}
+		case RecordPreCommit:
+			sv.txnState[key] = statePreCommitted
+		case RecordCommit:
+			sv.finalOps[rec.Tid] = append(sv.finalOps[rec.Tid], sv.txnLogs[key]...)
+			sv.txnState[key] = stateCommitted
+		case RecordAbort:
+			sv.txnState[key] = stateAborted
+		case RecordFinalize:
+			// Finalize (or an Optimistic commit, which finalizes in the
+			// same step) actually applied rec.Ops to the store - replay
+			// that directly from the record instead of trusting finalOps,
+			// since finalOps may have moved on since this was written.
+			if rec.Apply && len(rec.Ops) > 0 && i > snapshot {
+				sv.nextTS++
+				commitTS := sv.nextTS
+				for _, op := range rec.Ops {
+					if op.OpType != "set" {
+						continue
+					}
+					if item, ok := sv.store[op.Key]; ok {
+						item.versions = append(item.versions, version{value: op.Value, commitTS: commitTS, txnID: rec.Tid, siblingsBloom: rec.Bloom})
+					}
+				}
+			}
+			delete(sv.finalOps, rec.Tid)
+			finalized[rec.Tid] = true
+		}
+	}
+
+	for key, state := range sv.txnState {
+		if sv.txnMode[key.Tid] == Optimistic {
+			// Optimistic transactions never take item.mu locks - their
+			// durable state is txnMode/writeSet/writeBloom, restored above.
+			continue
+		}
+		switch {
+		case state == stateVotedYes || state == statePreCommitted:
+			var lockedKeys []string
+			for _, op := range sv.txnLogs[key] {
+				if op.OpType != "set" {
+					continue
+				}
+				item, ok := sv.store[op.Key]
+				if !ok {
+					continue
+				}
+				item.mu.Lock() // a freshly started process, so this always succeeds
+				lockedKeys = append(lockedKeys, op.Key)
+			}
+			sv.heldLocks[key] = lockedKeys
+
+		case state == stateCommitted && !finalized[key.Tid]:
+			for _, op := range sv.txnLogs[key] {
+				if op.OpType != "set" {
+					continue
+				}
+				item, ok := sv.store[op.Key]
+				if !ok {
+					continue
+				}
+				item.mu.Lock()
+				sv.finalLocks[key.Tid] = append(sv.finalLocks[key.Tid], op.Key)
+			}
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package commit
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestOptimisticVoteSurvivesCrashBeforeCommit reproduces the exact
+// sequence from the chunk0-7 review: SetOptimistic, a durably recorded
+// VotedYes, a simulated crash (rebuilding the Server from the same WAL
+// path), then Commit. The buffered write must survive even though it was
+// never applied to the store before the crash.
+func TestOptimisticVoteSurvivesCrashBeforeCommit(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "wal.log")
+
+	sv := MakeServer([]string{"a"}, walPath)
+	sv.SetOptimistic(1, "a", "durable-value")
+
+	var prep PrepareReply
+	sv.Prepare(&RPCArgs{Tid: 1, Isolation: SerializableSnapshot}, &prep)
+	if !prep.VoteYes {
+		t.Fatalf("expected tid 1 to vote yes, got VoteYes=false")
+	}
+	sv.Close()
+
+	// Simulated crash: rebuild the Server from the same WAL path before
+	// the coordinator's follow-up Commit ever arrives.
+	sv2 := MakeServer([]string{"a"}, walPath)
+	defer sv2.Close()
+
+	var commitReply CommitReply
+	sv2.Commit(&RPCArgs{Tid: 1}, &commitReply)
+
+	var rampReply RAMPGetReply
+	sv2.RAMPGet(&RAMPGetArgs{Keys: []string{"a"}}, &rampReply)
+	result, ok := rampReply.Results["a"]
+	if !ok {
+		t.Fatal("recovered server lost tid 1's write entirely")
+	}
+	if result.Value != "durable-value" {
+		t.Fatalf("got value %v, want %q", result.Value, "durable-value")
+	}
+}
+
+// TestReadOnlyOptimisticVoteSurvivesCrash checks a tid that only ever
+// GetOptimistic'd (never SetOptimistic, so its yes vote carries an empty
+// Ops) is still recovered as Optimistic rather than being misclassified
+// as Pessimistic, which would route its later Commit into the wrong
+// branch entirely.
+func TestReadOnlyOptimisticVoteSurvivesCrash(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "wal.log")
+
+	sv := MakeServer([]string{"a"}, walPath)
+	sv.GetOptimistic(1, "a", SerializableSnapshot)
+
+	var prep PrepareReply
+	sv.Prepare(&RPCArgs{Tid: 1, Isolation: SerializableSnapshot}, &prep)
+	if !prep.VoteYes {
+		t.Fatalf("expected read-only tid 1 to vote yes, got VoteYes=false")
+	}
+	sv.Close()
+
+	sv2 := MakeServer([]string{"a"}, walPath)
+	defer sv2.Close()
+
+	if mode := sv2.txnMode[1]; mode != Optimistic {
+		t.Fatalf("recovered tid 1 as mode %v, want Optimistic", mode)
+	}
+
+	var commitReply CommitReply
+	sv2.Commit(&RPCArgs{Tid: 1}, &commitReply)
+}